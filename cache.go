@@ -0,0 +1,200 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// Cache stores the last known ScanResult for a scan key (a mode+address
+// pair, see scanWithCache) with a per-entry TTL.
+type Cache interface {
+	Get(key string) (result ScanResult, ok bool, err error)
+	Set(key string, result ScanResult, ttl time.Duration) error
+}
+
+// newCache builds the Cache selected by -cache-backend, returning a close
+// func to release any underlying resources (a no-op if there's nothing to
+// close).
+func newCache(backend, dsn string) (Cache, func() error, error) {
+	switch backend {
+	case "", "badger":
+		return newBadgerCache(dsn)
+	case "memory":
+		return newMemoryCache(dsn), func() error { return nil }, nil
+	case "redis":
+		return newRedisCache(dsn)
+	default:
+		return nil, nil, fmt.Errorf("unknown cache backend %q", backend)
+	}
+}
+
+// badgerCache is the original on-disk cache backend.
+type badgerCache struct {
+	db *badger.DB
+}
+
+func newBadgerCache(path string) (*badgerCache, func() error, error) {
+	if path == "" {
+		path = dbPath
+	}
+
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &badgerCache{db: db}, db.Close, nil
+}
+
+func (c *badgerCache) Get(key string) (result ScanResult, ok bool, err error) {
+	err = c.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return nil
+			}
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			ok = true
+			result = ScanResult(val[0])
+			return nil
+		})
+	})
+	return
+}
+
+func (c *badgerCache) Set(key string, result ScanResult, ttl time.Duration) error {
+	entry := badger.NewEntry([]byte(key), []byte{byte(result)}).WithTTL(ttl)
+
+	return c.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(entry)
+	})
+}
+
+// memoryCache is a pure in-memory LRU, useful for ephemeral containers
+// where the .cache volume backing badger is undesirable. Entries beyond
+// maxEntries are evicted least-recently-used first; entries past their TTL
+// are treated as a miss and evicted lazily on access.
+type memoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key       string
+	result    ScanResult
+	expiresAt time.Time
+}
+
+const defaultMemoryCacheSize = 100_000
+
+func newMemoryCache(dsn string) *memoryCache {
+	maxEntries := defaultMemoryCacheSize
+	if n, err := strconv.Atoi(dsn); err == nil && n > 0 {
+		maxEntries = n
+	}
+
+	return &memoryCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+	}
+}
+
+func (c *memoryCache) Get(key string) (result ScanResult, ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.items[key]
+	if !found {
+		return Closed, false, nil
+	}
+
+	entry := el.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return Closed, false, nil
+	}
+
+	c.ll.MoveToFront(el)
+	return entry.result, true, nil
+}
+
+func (c *memoryCache) Set(key string, result ScanResult, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, found := c.items[key]; found {
+		entry := el.Value.(*memoryCacheEntry)
+		entry.result = result
+		entry.expiresAt = time.Now().Add(ttl)
+		c.ll.MoveToFront(el)
+		return nil
+	}
+
+	el := c.ll.PushFront(&memoryCacheEntry{key: key, result: result, expiresAt: time.Now().Add(ttl)})
+	c.items[key] = el
+
+	if c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*memoryCacheEntry).key)
+		}
+	}
+
+	return nil
+}
+
+// redisCache shares cache state across exporter replicas, unlike badger
+// which holds an exclusive file lock on its data directory.
+type redisCache struct {
+	client *redis.Client
+}
+
+func newRedisCache(dsn string) (*redisCache, func() error, error) {
+	opts := &redis.Options{Addr: dsn}
+	if dsn == "" {
+		opts.Addr = "localhost:6379"
+	}
+
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, nil, fmt.Errorf("connect to redis: %w", err)
+	}
+
+	return &redisCache{client: client}, client.Close, nil
+}
+
+func (c *redisCache) Get(key string) (result ScanResult, ok bool, err error) {
+	val, err := c.client.Get(context.Background(), key).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return Closed, false, nil
+		}
+		return Closed, false, err
+	}
+	if len(val) == 0 {
+		return Closed, false, nil
+	}
+	return ScanResult(val[0]), true, nil
+}
+
+func (c *redisCache) Set(key string, result ScanResult, ttl time.Duration) error {
+	return c.client.Set(context.Background(), key, []byte{byte(result)}, ttl).Err()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+)
+
+var excludes []string
+
+func parseExcludes() func(s string) error {
+	return func(s string) error {
+		excludes = strings.Split(s, ",")
+		return nil
+	}
+}
+
+var srvPattern = regexp.MustCompile(`^_([^._]+)\._([^._]+)\.(.+)$`)
+
+// maxExpandedHosts caps how many addresses a single CIDR/range spec can
+// expand into per call. Without this, a fat-fingered -hosts 10.0.0.0/8 (or
+// /0) would try to allocate and scan 16M+ entries every cycle - including
+// every /sd poll hitting handleTargets - which in practice hangs the
+// exporter rather than "scanning a large subnet".
+const maxExpandedHosts = 65536 // one /16 worth
+
+// expandTargets turns the raw, user-configured specs (bare hostnames,
+// CIDR blocks, IP ranges, or DNS SRV names) into concrete hosts to scan
+// this cycle. CIDRs and ranges are expanded here rather than once at
+// startup so a /16 in -hosts doesn't sit materialized in memory between
+// scans, and SRV records are re-resolved every call so service-discovery
+// changes propagate without a restart.
+func expandTargets(ctx context.Context, specs []string, excludeSpecs []string) []string {
+	excludeNets := parseExcludeNets(excludeSpecs)
+
+	var out []string
+	for _, spec := range specs {
+		switch {
+		case isCIDR(spec):
+			out = append(out, expandCIDR(spec, excludeNets)...)
+		case isIPRange(spec):
+			out = append(out, expandIPRange(spec, excludeNets)...)
+		case isSRV(spec):
+			out = append(out, resolveSRV(ctx, spec)...)
+		default:
+			// A bare hostname can't be checked against -exclude's
+			// CIDRs/IPs without a DNS lookup, but a bare IP can.
+			if ip := net.ParseIP(spec); ip != nil && isExcluded(ip, excludeNets) {
+				continue
+			}
+			out = append(out, spec)
+		}
+	}
+	return out
+}
+
+func isCIDR(s string) bool {
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
+
+func isIPRange(s string) bool {
+	start, end, ok := parseIPRange(s)
+	return ok && start != nil && end != nil
+}
+
+func parseIPRange(s string) (net.IP, net.IP, bool) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return nil, nil, false
+	}
+
+	start := net.ParseIP(strings.TrimSpace(parts[0]))
+	end := net.ParseIP(strings.TrimSpace(parts[1]))
+	if start == nil || end == nil {
+		return nil, nil, false
+	}
+
+	return start, end, true
+}
+
+func isSRV(s string) bool {
+	return srvPattern.MatchString(s)
+}
+
+func expandCIDR(cidr string, excludeNets []*net.IPNet) []string {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil
+	}
+
+	var out []string
+	for ip := cloneIP(ipnet.IP.Mask(ipnet.Mask)); ipnet.Contains(ip); incIP(ip) {
+		if isExcluded(ip, excludeNets) {
+			continue
+		}
+		if len(out) >= maxExpandedHosts {
+			slog.Warn("cidr expansion truncated", slog.String("cidr", cidr), slog.Int("limit", maxExpandedHosts))
+			break
+		}
+		out = append(out, ip.String())
+	}
+	return out
+}
+
+func expandIPRange(spec string, excludeNets []*net.IPNet) []string {
+	start, end, ok := parseIPRange(spec)
+	if !ok {
+		return nil
+	}
+
+	var out []string
+	for ip := cloneIP(start); bytesCompare(ip, end) <= 0; incIP(ip) {
+		if isExcluded(ip, excludeNets) {
+			if bytesCompare(ip, end) == 0 {
+				break
+			}
+			continue
+		}
+		if len(out) >= maxExpandedHosts {
+			slog.Warn("ip range expansion truncated", slog.String("range", spec), slog.Int("limit", maxExpandedHosts))
+			break
+		}
+		out = append(out, ip.String())
+
+		if bytesCompare(ip, end) == 0 {
+			break
+		}
+	}
+	return out
+}
+
+func resolveSRV(ctx context.Context, spec string) []string {
+	m := srvPattern.FindStringSubmatch(spec)
+	if m == nil {
+		return nil
+	}
+	service, proto, name := m[1], m[2], m[3]
+
+	_, addrs, err := net.DefaultResolver.LookupSRV(ctx, service, proto, name)
+	if err != nil {
+		slog.Error("failed to resolve SRV record", slog.String("spec", spec), slog.String("error", err.Error()))
+		return nil
+	}
+
+	out := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		out = append(out, strings.TrimSuffix(a.Target, "."))
+	}
+	return out
+}
+
+func parseExcludeNets(specs []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range specs {
+		if s == "" {
+			continue
+		}
+		if _, ipnet, err := net.ParseCIDR(s); err == nil {
+			nets = append(nets, ipnet)
+			continue
+		}
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	return nets
+}
+
+func isExcluded(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func cloneIP(ip net.IP) net.IP {
+	out := make(net.IP, len(ip))
+	copy(out, ip)
+	return out
+}
+
+func incIP(ip net.IP) {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			return
+		}
+	}
+}
+
+func bytesCompare(a, b net.IP) int {
+	a4, b4 := a.To16(), b.To16()
+	for i := range a4 {
+		if a4[i] != b4[i] {
+			return int(a4[i]) - int(b4[i])
+		}
+	}
+	return 0
+}
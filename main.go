@@ -7,7 +7,6 @@ import (
 	"flag"
 	"fmt"
 	"log/slog"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -16,7 +15,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/dgraph-io/badger/v4"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -33,22 +31,59 @@ var (
 	hosts = []string{"localhost"}
 	ports = []uint16{22, 80, 443}
 
-	maxConn     = 100
-	connTimeout = 10 * time.Second
+	maxConn       = 100
+	connTimeout   = 10 * time.Second
+	bannerTimeout = 2 * time.Second
 
 	cacheExpires         = 72 * time.Hour
 	openPortCacheExpires = 15 * time.Minute
+	filteredCacheExpires = 5 * time.Minute
 
-	dbPath = ".cache"
-	db     *badger.DB
+	dbPath       = ".cache"
+	cacheBackend = "badger"
+	cacheDSN     string
+
+	cache Cache
 
 	openPorts = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "open_port",
 			Help: "Status of open ports (1 - open)",
 		},
+		[]string{"host", "port", "mode"},
+	)
+
+	tlsCertExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "open_port_tls_cert_expiry_seconds",
+			Help: "Unix timestamp of the TLS certificate's NotAfter",
+		},
 		[]string{"host", "port"},
 	)
+
+	tlsInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "open_port_tls_info",
+			Help: "TLS certificate subject/issuer, value is always 1",
+		},
+		[]string{"host", "port", "subject", "issuer"},
+	)
+
+	bannerInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "open_port_banner_info",
+			Help: "Service fingerprint from the connection banner, value is always 1",
+		},
+		[]string{"host", "port", "service", "banner_hash"},
+	)
+
+	scanResultTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "open_port_scan_result_total",
+			Help: "Count of scans by tri-state result (open, closed, filtered)",
+		},
+		[]string{"result"},
+	)
 )
 
 func command() error {
@@ -56,14 +91,25 @@ func command() error {
 	defer stop()
 
 	flag.StringVar(&addr, "web.listen-address", ":9116", "listen address")
-	flag.Func("hosts", "hosts to scan ports for (comma-separated)", parseHosts())
+	flag.Func("hosts", "hosts to scan ports for: hostnames, CIDRs, IP ranges, or DNS SRV names (comma-separated)", parseHosts())
 	flag.Func("ports", "ports to scan (80,443, 100-200)", parsePorts())
-	flag.Func("list", "list of hosts to scan ports (file)", parseHostsListFile())
+	flag.Func("list", "list of hosts to scan ports (file, same formats as -hosts)", parseHostsListFile())
+	flag.Func("exclude", "CIDRs/IPs to subtract from hosts (comma-separated)", parseExcludes())
+	flag.Func("scan-modes", "scan modes to use: tcp, udp, tls, tls-sni:<hostname> (comma-separated)", parseScanModes())
+	flag.StringVar(&targetsURL, "targets-url", "", "URL to poll for a dynamic host list (Prometheus HTTP SD JSON)")
+	flag.BoolVar(&targetsFileReload, "targets-file-reload", false, "watch the -list file and reload hosts at runtime")
+	flag.Float64Var(&scanRate, "scan-rate", scanRate, "maximum scan rate in probes/sec (0 = unlimited)")
+	flag.IntVar(&perHostMaxConnections, "per-host-max-connections", perHostMaxConnections, "maximum concurrent connections per host")
+	flag.BoolVar(&adaptive, "adaptive", adaptive, "shrink/grow per-host concurrency based on rolling dial error rate")
 	flag.IntVar(&maxConn, "max-connections", maxConn, "maximum number of connections")
 	flag.DurationVar(&connTimeout, "timeout", connTimeout, "timeout for connection")
+	flag.DurationVar(&bannerTimeout, "banner-timeout", bannerTimeout, "timeout for reading a connection banner")
 	flag.DurationVar(&cacheExpires, "cache-expires", cacheExpires, "cache expiration time")
 	flag.DurationVar(&openPortCacheExpires, "open-port-cache-expires", openPortCacheExpires, "open port cache expiration time")
-	flag.StringVar(&dbPath, "cache-path", dbPath, "path to cache database")
+	flag.DurationVar(&filteredCacheExpires, "filtered-cache-expires", filteredCacheExpires, "filtered port cache expiration time")
+	flag.StringVar(&dbPath, "cache-path", dbPath, "path to cache database (badger backend only)")
+	flag.StringVar(&cacheBackend, "cache-backend", cacheBackend, "cache backend to use: badger, memory or redis")
+	flag.StringVar(&cacheDSN, "cache-dsn", cacheDSN, "connection info for the cache backend (redis address, or memory max entries)")
 	flag.Parse()
 
 	slog.Info("listening", slog.String("address", addr))
@@ -72,23 +118,29 @@ func command() error {
 	slog.Info("max connections", slog.Int("count", maxConn))
 	slog.Info("timeout", slog.Duration("timeout", connTimeout))
 
-	prometheus.MustRegister(openPorts)
+	prometheus.MustRegister(openPorts, tlsCertExpiry, tlsInfo, bannerInfo, scannerInflight, scannerRate, scannerErrors, scanResultTotal)
 
-	var err error
+	if scanRate > 0 {
+		rateLimiter = newTokenBucket(scanRate)
+	}
+	scannerRate.Set(scanRate)
 
-	dbOpts := badger.DefaultOptions(dbPath)
-	dbOpts.Logger = nil
+	var err error
 
-	db, err = badger.Open(dbOpts)
+	var closeCache func() error
+	cache, closeCache, err = newCache(cacheBackend, cacheDSN)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	defer closeCache()
 
 	go scanner(ctx)
+	watchTargets(ctx)
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/targets", handleTargets)
+	mux.HandleFunc("/sd", handleTargets)
 
 	srv := &http.Server{
 		Addr:    addr,
@@ -145,31 +197,67 @@ func scanAll(ctx context.Context) {
 
 	wg := sync.WaitGroup{}
 
-top:
-	for _, host := range hosts {
-		for _, port := range ports {
-			select {
-			case semaphore <- struct{}{}:
-			case <-ctx.Done():
-				break top
-			}
+	targetsMu.RLock()
+	rawSpecs := append([]string(nil), hosts...)
+	excludeSpecs := append([]string(nil), excludes...)
+	targetsMu.RUnlock()
 
-			wg.Add(1)
+	hostsSnapshot := expandTargets(ctx, rawSpecs, excludeSpecs)
 
-			go func(host string, port uint16) {
-				defer wg.Done()
-				defer func() { <-semaphore }()
+hostLoop:
+	for _, host := range hostsSnapshot {
+		hostCtx := registerHostContext(ctx, host)
+		limiter := getHostLimiter(host)
+
+		for _, port := range ports {
+			for _, mode := range scanModes {
+				if err := rateLimiter.wait(hostCtx); err != nil {
+					continue hostLoop
+				}
 
-				if open, err := scanWithCache(fmt.Sprintf("%s:%d", host, port)); err != nil {
-					slog.Error("failed to scan", slog.String("host", host), slog.Int("port", int(port)), slog.String("error", err.Error()))
-					return
-				} else if open {
-					openPorts.WithLabelValues(host, strconv.Itoa(int(port))).Set(1)
-					slog.Info("open port", slog.String("host", host), slog.Int("port", int(port)))
-				} else {
-					slog.Debug("closed port", slog.String("host", host), slog.Int("port", int(port)))
+				select {
+				case semaphore <- struct{}{}:
+				case <-ctx.Done():
+					break hostLoop
+				case <-hostCtx.Done():
+					continue hostLoop
 				}
-			}(host, port)
+
+				if err := limiter.acquire(hostCtx); err != nil {
+					<-semaphore
+					continue hostLoop
+				}
+
+				wg.Add(1)
+				scannerInflight.Inc()
+
+				go func(hostCtx context.Context, host string, port uint16, mode ScanMode, limiter *hostLimiter) {
+					defer wg.Done()
+					defer scannerInflight.Dec()
+					defer func() { <-semaphore }()
+					defer limiter.release()
+
+					addr := fmt.Sprintf("%s:%d", host, port)
+
+					result, err := scanWithCache(hostCtx, addr, mode, limiter)
+					if err != nil {
+						slog.Error("failed to scan", slog.String("host", host), slog.Int("port", int(port)), slog.String("mode", mode.Key()), slog.String("error", err.Error()))
+						return
+					}
+
+					scanResultTotal.WithLabelValues(result.String()).Inc()
+
+					switch result {
+					case Open:
+						openPorts.WithLabelValues(host, strconv.Itoa(int(port)), mode.Key()).Set(1)
+						slog.Info("open port", slog.String("host", host), slog.Int("port", int(port)), slog.String("mode", mode.Key()))
+					case Filtered:
+						slog.Debug("filtered port", slog.String("host", host), slog.Int("port", int(port)), slog.String("mode", mode.Key()))
+					default:
+						slog.Debug("closed port", slog.String("host", host), slog.Int("port", int(port)), slog.String("mode", mode.Key()))
+					}
+				}(hostCtx, host, port, mode, limiter)
+			}
 		}
 	}
 
@@ -188,6 +276,9 @@ func parseHostsListFile() func(s string) error {
 		for sc.Scan() {
 			hosts = append(hosts, sc.Text())
 		}
+
+		targetsFilePath = s
+
 		return sc.Err()
 	}
 }
@@ -223,67 +314,35 @@ func parseHosts() func(s string) error {
 	}
 }
 
-func getCache(addr string) (open bool, ok bool, err error) {
-	err = db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(addr))
-		if err != nil {
-			if errors.Is(err, badger.ErrKeyNotFound) {
-				return nil
-			}
-			return err
-		}
-		return item.Value(func(val []byte) error {
-			ok = true
-			open = val[0] == 1
-			return nil
-		})
-	})
-	return
-}
+func scanWithCache(ctx context.Context, addr string, mode ScanMode, limiter *hostLimiter) (ScanResult, error) {
+	key := mode.Key() + "|" + addr
 
-func setCache(addr string, open bool) error {
-	entry := badger.NewEntry([]byte(addr), make([]byte, 1))
-
-	if open {
-		entry.Value[0] = 1
-		entry.WithTTL(openPortCacheExpires)
-	} else {
-		entry.WithTTL(cacheExpires)
-	}
-
-	return db.Update(func(txn *badger.Txn) error {
-		return txn.SetEntry(entry)
-	})
-}
-
-func scanWithCache(addr string) (bool, error) {
-	open, ok, err := getCache(addr)
+	result, ok, err := cache.Get(key)
 	if err != nil {
-		return false, err
+		return Closed, err
 	}
 
 	if ok {
-		return open, nil
+		return result, nil
 	}
 
-	if open, err = scan(addr); err != nil {
-		return false, err
+	if result, err = scanAddr(ctx, addr, mode, limiter); err != nil {
+		return Closed, err
 	}
 
-	if err = setCache(addr, open); err != nil {
-		return false, err
+	var ttl time.Duration
+	switch result {
+	case Open:
+		ttl = openPortCacheExpires
+	case Filtered:
+		ttl = filteredCacheExpires
+	default:
+		ttl = cacheExpires
 	}
 
-	return open, nil
-}
-
-func scan(addr string) (bool, error) {
-	c, err := net.DialTimeout("tcp", addr, connTimeout)
-	if err != nil {
-		if strings.Contains(err.Error(), "too many open files") {
-			return false, err
-		}
+	if err = cache.Set(key, result, ttl); err != nil {
+		return Closed, err
 	}
-	c.Close()
-	return true, nil
+
+	return result, nil
 }
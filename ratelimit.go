@@ -0,0 +1,262 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	scanRate              float64 // probes per second across all hosts, 0 = unlimited
+	perHostMaxConnections = 10
+	adaptive              bool
+
+	rateLimiter *tokenBucket
+
+	// hostLimiters is bounded LRU, not an unbounded map: -hosts can expand
+	// to CIDRs/ranges/SRV lookups whose membership changes over time (see
+	// expand.go), so without a cap a long-running exporter swept over a
+	// rotating or growing target set would leak one hostLimiter forever
+	// per distinct host string it has ever seen.
+	hostLimitersMu sync.Mutex
+	hostLimitersLL = list.New()
+	hostLimiters   = map[string]*list.Element{}
+
+	scannerInflight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "open_port_scanner_inflight",
+		Help: "Number of scans currently in flight",
+	})
+
+	scannerRate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "open_port_scanner_rate",
+		Help: "Configured scan rate in probes/sec (0 = unlimited)",
+	})
+
+	scannerErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "open_port_scanner_errors_total",
+			Help: "Scan errors by classified reason",
+		},
+		[]string{"reason"},
+	)
+)
+
+// tokenBucket is a small token-bucket rate limiter sized to one second's
+// worth of tokens, used to pace probes/sec across the whole scanner.
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	tokens   float64
+	capacity float64
+	last     time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, capacity: rate, last: time.Now()}
+}
+
+func (b *tokenBucket) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.mu.Unlock()
+		return nil
+	}
+
+	// Take the token now, leaving the bucket in debt, so callers arriving
+	// during this wait queue up behind it instead of sharing its token.
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	b.tokens--
+	b.mu.Unlock()
+
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// hostLimiter caps concurrent connections to a single host and, when
+// -adaptive is set, grows or shrinks that cap based on the rolling dial
+// error rate (AIMD-style: halve on sustained errors, double on clean
+// windows).
+type hostLimiter struct {
+	sem     chan struct{}
+	allowed atomic.Int32
+
+	mu          sync.Mutex
+	windowTotal int
+	windowErrs  int
+}
+
+const adaptiveWindowSize = 20
+
+// maxHostLimiters bounds memory when the host set is large or churns
+// (CIDR/range expansion, SRV resolution, -targets-url/-targets-file-reload).
+// Past this, the least-recently-used host's limiter is evicted and rebuilt
+// from scratch (with a fresh adaptive window) the next time it's scanned.
+const maxHostLimiters = 10_000
+
+type hostLimiterEntry struct {
+	host    string
+	limiter *hostLimiter
+}
+
+func newHostLimiter() *hostLimiter {
+	l := &hostLimiter{sem: make(chan struct{}, perHostMaxConnections)}
+	l.allowed.Store(int32(perHostMaxConnections))
+	return l
+}
+
+func getHostLimiter(host string) *hostLimiter {
+	hostLimitersMu.Lock()
+	defer hostLimitersMu.Unlock()
+
+	if el, ok := hostLimiters[host]; ok {
+		hostLimitersLL.MoveToFront(el)
+		return el.Value.(*hostLimiterEntry).limiter
+	}
+
+	l := newHostLimiter()
+	el := hostLimitersLL.PushFront(&hostLimiterEntry{host: host, limiter: l})
+	hostLimiters[host] = el
+
+	if hostLimitersLL.Len() > maxHostLimiters {
+		oldest := hostLimitersLL.Back()
+		if oldest != nil {
+			hostLimitersLL.Remove(oldest)
+			delete(hostLimiters, oldest.Value.(*hostLimiterEntry).host)
+		}
+	}
+
+	return l
+}
+
+// deleteHostLimiter drops a host's limiter immediately, e.g. when
+// cancelHost (targets.go) observes the host leaving the target set.
+func deleteHostLimiter(host string) {
+	hostLimitersMu.Lock()
+	defer hostLimitersMu.Unlock()
+
+	if el, ok := hostLimiters[host]; ok {
+		hostLimitersLL.Remove(el)
+		delete(hostLimiters, host)
+	}
+}
+
+// acquire blocks until a slot under the host's current effective limit is
+// free, ctx is canceled, or an error occurs. The effective limit can shrink
+// below the channel's capacity (perHostMaxConnections) while adaptive
+// adjustment is in effect, so this polls rather than relying solely on
+// channel capacity.
+func (l *hostLimiter) acquire(ctx context.Context) error {
+	for {
+		if int32(len(l.sem)) < l.allowed.Load() {
+			select {
+			case l.sem <- struct{}{}:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func (l *hostLimiter) release() {
+	<-l.sem
+}
+
+// recordOutcome feeds one dial result into the rolling error-rate window
+// and adjusts the effective concurrency once the window fills.
+func (l *hostLimiter) recordOutcome(errReason string) {
+	if !adaptive {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.windowTotal++
+	if errReason != "" {
+		l.windowErrs++
+	}
+
+	if l.windowTotal < adaptiveWindowSize {
+		return
+	}
+
+	errRate := float64(l.windowErrs) / float64(l.windowTotal)
+	switch {
+	case errRate > 0.3:
+		if next := l.allowed.Load() / 2; next >= 1 {
+			l.allowed.Store(next)
+		}
+	case errRate == 0:
+		if next := l.allowed.Load() * 2; next <= int32(perHostMaxConnections) {
+			l.allowed.Store(next)
+		}
+	}
+
+	l.windowTotal, l.windowErrs = 0, 0
+}
+
+// classifyDialErr buckets a dial error into the reason labels
+// exposed on open_port_scanner_errors_total. Returns "" for a nil error.
+func classifyDialErr(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "too many open files"):
+		return "too_many_open_files"
+	case strings.Contains(msg, "connection refused"):
+		return "connection_refused"
+	case strings.Contains(msg, "i/o timeout"), strings.Contains(msg, "deadline exceeded"):
+		return "deadline_exceeded"
+	default:
+		return "other"
+	}
+}
+
+// recordDialOutcome classifies a dial result, counts it, and feeds the
+// host's adaptive window. limiter must be the same *hostLimiter the caller
+// is gating concurrency for host with - not a fresh getHostLimiter(host)
+// lookup, which can return a different instance once the host's original
+// entry is evicted from the bounded LRU, silently detaching adaptive
+// backpressure from the limiter actually in effect.
+func recordDialOutcome(limiter *hostLimiter, err error) {
+	reason := classifyDialErr(err)
+	if reason != "" {
+		scannerErrors.WithLabelValues(reason).Inc()
+	}
+	limiter.recordOutcome(reason)
+}
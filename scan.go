@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lastTLSInfo and lastBannerInfo remember the label combination last
+// published per host:port so publishTLSInfo/publishBanner can delete it
+// before setting the new one. Without this, a cert renewal (subject/issuer
+// change) or a banner carrying a timestamp/session id (bannerHash change)
+// would each leave the old time series behind forever instead of being
+// replaced, growing tlsInfo/bannerInfo's cardinality without bound on
+// exactly the long-lived hosts this exporter watches continuously.
+var (
+	tlsInfoMu   sync.Mutex
+	lastTLSInfo = map[string][2]string{} // host:port -> [subject, issuer]
+
+	bannerInfoMu   sync.Mutex
+	lastBannerInfo = map[string][2]string{} // host:port -> [service, bannerHash]
+)
+
+// ScanMode describes one protocol to probe a port with. The zero value
+// scans plain TCP.
+type ScanMode struct {
+	Protocol string // "tcp", "udp" or "tls"
+	SNIHost  string // set when Protocol is "tls" and a -scan-modes entry used tls-sni:<hostname>
+}
+
+// Key returns a short, cache-stable identifier for the mode.
+func (m ScanMode) Key() string {
+	if m.Protocol == "tls" && m.SNIHost != "" {
+		return "tls-sni:" + m.SNIHost
+	}
+	return m.Protocol
+}
+
+func (m ScanMode) String() string {
+	return m.Key()
+}
+
+var scanModes = []ScanMode{{Protocol: "tcp"}}
+
+func parseScanModes() func(s string) error {
+	return func(s string) error {
+		var modes []ScanMode
+		for _, part := range strings.Split(s, ",") {
+			part = strings.TrimSpace(part)
+			switch {
+			case part == "tcp", part == "udp", part == "tls":
+				modes = append(modes, ScanMode{Protocol: part})
+			case strings.HasPrefix(part, "tls-sni:"):
+				host := strings.TrimPrefix(part, "tls-sni:")
+				if host == "" {
+					return fmt.Errorf("tls-sni scan mode requires a hostname: %q", part)
+				}
+				modes = append(modes, ScanMode{Protocol: "tls", SNIHost: host})
+			default:
+				return fmt.Errorf("unknown scan mode %q", part)
+			}
+		}
+		if len(modes) == 0 {
+			return fmt.Errorf("no scan modes given")
+		}
+		scanModes = modes
+		return nil
+	}
+}
+
+// banner holds the service fingerprint captured for a single scan.
+type banner struct {
+	service    string
+	bannerHash string
+}
+
+// ScanResult is the tri-state outcome of a single probe. Closed and
+// Filtered are both "not open" but mean different things operationally:
+// Closed is a confirmed refusal, Filtered is "no answer either way"
+// (a timeout, or a firewall dropping packets silently).
+type ScanResult int
+
+const (
+	Closed ScanResult = iota
+	Open
+	Filtered
+)
+
+func (r ScanResult) String() string {
+	switch r {
+	case Open:
+		return "open"
+	case Filtered:
+		return "filtered"
+	default:
+		return "closed"
+	}
+}
+
+// scanAddr probes addr with the given mode and reports its tri-state
+// result. Banner/TLS details, when available, are published to the
+// relevant metrics directly since they don't fit the cache below. ctx is
+// the host's context from registerHostContext: canceling it (e.g. because
+// the host dropped out of the target set) aborts the dial and any
+// in-progress read rather than letting them run to connTimeout. limiter is
+// the same *hostLimiter scanAll is gating concurrency with for this host,
+// passed through so the adaptive error window it feeds is the one actually
+// controlling that host's concurrency rather than a fresh lookup that may
+// have been evicted from the bounded LRU in getHostLimiter.
+func scanAddr(ctx context.Context, addr string, mode ScanMode, limiter *hostLimiter) (ScanResult, error) {
+	switch mode.Protocol {
+	case "udp":
+		return scanUDP(ctx, addr, limiter)
+	case "tls":
+		return scanTLS(ctx, addr, mode.SNIHost, limiter)
+	default:
+		return scanTCP(ctx, addr, limiter)
+	}
+}
+
+// closeOnDone closes conn as soon as ctx is canceled, unblocking any
+// in-flight Read/Write. The returned func must be called once the caller
+// is done with conn to stop the watcher goroutine leaking.
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// resultForDialErr classifies a failed dial into a ScanResult,
+// or into an error when the failure is a retryable resource exhaustion
+// (e.g. too many open files) rather than a property of the target port.
+func resultForDialErr(err error) (ScanResult, error) {
+	switch classifyDialErr(err) {
+	case "too_many_open_files":
+		return Closed, err
+	case "deadline_exceeded":
+		return Filtered, nil
+	default: // connection_refused, other
+		return Closed, nil
+	}
+}
+
+func scanTCP(ctx context.Context, addr string, limiter *hostLimiter) (ScanResult, error) {
+	host, port, _ := net.SplitHostPort(addr)
+
+	dialer := &net.Dialer{Timeout: connTimeout}
+	c, err := dialer.DialContext(ctx, "tcp", addr)
+	recordDialOutcome(limiter, err)
+	if err != nil {
+		return resultForDialErr(err)
+	}
+	defer c.Close()
+
+	stop := closeOnDone(ctx, c)
+	defer stop()
+
+	if b := captureBanner(c); b != nil {
+		publishBanner(host, port, b)
+	}
+
+	return Open, nil
+}
+
+func scanTLS(ctx context.Context, addr, sniHost string, limiter *hostLimiter) (ScanResult, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Closed, err
+	}
+	serverName := sniHost
+	if serverName == "" {
+		serverName = host
+	}
+
+	tlsDialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: connTimeout},
+		Config: &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		},
+	}
+	conn, err := tlsDialer.DialContext(ctx, "tcp", addr)
+	recordDialOutcome(limiter, err)
+	if err != nil {
+		return resultForDialErr(err)
+	}
+	defer conn.Close()
+
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	c := conn.(*tls.Conn)
+	state := c.ConnectionState()
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		tlsCertExpiry.WithLabelValues(host, port).Set(float64(cert.NotAfter.Unix()))
+		publishTLSInfo(host, port, cert.Subject.String(), cert.Issuer.String())
+	}
+
+	if b := captureBanner(c); b != nil {
+		publishBanner(host, port, b)
+	}
+
+	return Open, nil
+}
+
+func scanUDP(ctx context.Context, addr string, limiter *hostLimiter) (ScanResult, error) {
+	host, portStr, _ := net.SplitHostPort(addr)
+
+	dialer := &net.Dialer{Timeout: connTimeout}
+	c, err := dialer.DialContext(ctx, "udp", addr)
+	recordDialOutcome(limiter, err)
+	if err != nil {
+		return resultForDialErr(err)
+	}
+	defer c.Close()
+
+	stop := closeOnDone(ctx, c)
+	defer stop()
+
+	if _, err := c.Write(udpProbeFor(portStr)); err != nil {
+		return Closed, nil
+	}
+
+	_ = c.SetReadDeadline(time.Now().Add(connTimeout))
+
+	buf := make([]byte, 512)
+	if _, err := c.Read(buf); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// No reply at all: could be an open port that didn't
+			// respond to our probe, or a firewall dropping packets
+			// silently. Either way we can't tell open from closed.
+			return Filtered, nil
+		}
+		if strings.Contains(err.Error(), "connection refused") {
+			// ICMP port-unreachable surfaces as ECONNREFUSED on the
+			// next read/write of a connected UDP socket.
+			return Closed, nil
+		}
+		return Closed, err
+	}
+
+	return Open, nil
+}
+
+// udpProbeFor returns a small protocol-specific datagram for well-known
+// ports, falling back to an empty probe for everything else.
+func udpProbeFor(port string) []byte {
+	switch port {
+	case "53":
+		return dnsProbe
+	case "123":
+		return ntpProbe
+	default:
+		return []byte{}
+	}
+}
+
+// dnsProbe is a standard DNS query for the root NS record.
+var dnsProbe = []byte{
+	0xAA, 0xAA, // transaction ID
+	0x01, 0x00, // standard query, recursion desired
+	0x00, 0x01, // QDCOUNT
+	0x00, 0x00, // ANCOUNT
+	0x00, 0x00, // NSCOUNT
+	0x00, 0x00, // ARCOUNT
+	0x00,       // root name
+	0x00, 0x02, // QTYPE NS
+	0x00, 0x01, // QCLASS IN
+}
+
+// ntpProbe is a minimal SNTP client request (LI=0, VN=3, Mode=3).
+var ntpProbe = append([]byte{0x1B}, make([]byte, 47)...)
+
+// captureBanner reads up to 256 bytes from conn within bannerTimeout and
+// classifies the service that sent them. Returns nil if nothing arrived.
+// This is deliberately much shorter than connTimeout: most services never
+// send an unsolicited banner, so without a separate timeout every one of
+// them would hold its connection open (and its concurrency slot) for the
+// full connect timeout on every scan.
+func captureBanner(conn net.Conn) *banner {
+	_ = conn.SetReadDeadline(time.Now().Add(bannerTimeout))
+
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if n == 0 || err != nil {
+		return nil
+	}
+
+	data := buf[:n]
+	return &banner{
+		service:    classifyService(data),
+		bannerHash: bannerHash(data),
+	}
+}
+
+func classifyService(data []byte) string {
+	s := string(data)
+	switch {
+	case strings.HasPrefix(s, "SSH-"):
+		return "ssh"
+	case strings.HasPrefix(s, "HTTP/"):
+		return "http"
+	case strings.HasPrefix(s, "220 "), strings.HasPrefix(s, "220-"):
+		return "smtp-or-ftp"
+	case strings.HasPrefix(s, "+OK"):
+		return "pop3"
+	case strings.HasPrefix(s, "* OK"):
+		return "imap"
+	default:
+		return "unknown"
+	}
+}
+
+func bannerHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// publishTLSInfo sets tlsInfo for host:port, deleting the previously
+// published subject/issuer combination first (if any and if it changed)
+// so a cert renewal replaces its series instead of adding a new one.
+func publishTLSInfo(host, port, subject, issuer string) {
+	key := host + ":" + port
+	next := [2]string{subject, issuer}
+
+	tlsInfoMu.Lock()
+	if prev, ok := lastTLSInfo[key]; ok && prev != next {
+		tlsInfo.DeleteLabelValues(host, port, prev[0], prev[1])
+	}
+	lastTLSInfo[key] = next
+	tlsInfoMu.Unlock()
+
+	tlsInfo.WithLabelValues(host, port, subject, issuer).Set(1)
+}
+
+// publishBanner sets bannerInfo for host:port, deleting the previously
+// published service/bannerHash combination first (if any and if it
+// changed) so a banner that carries a timestamp or session id doesn't
+// accumulate a new series on every scan.
+func publishBanner(host, port string, b *banner) {
+	key := host + ":" + port
+	next := [2]string{b.service, b.bannerHash}
+
+	bannerInfoMu.Lock()
+	if prev, ok := lastBannerInfo[key]; ok && prev != next {
+		bannerInfo.DeleteLabelValues(host, port, prev[0], prev[1])
+	}
+	lastBannerInfo[key] = next
+	bannerInfoMu.Unlock()
+
+	bannerInfo.WithLabelValues(host, port, b.service, b.bannerHash).Set(1)
+}
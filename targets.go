@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const targetsPollInterval = 30 * time.Second
+
+var (
+	targetsURL        string
+	targetsFileReload bool
+	targetsFilePath   string // set by parseHostsListFile, watched when targetsFileReload is on
+
+	targetsMu sync.RWMutex
+
+	// hostCancels is a bounded LRU for the same reason hostLimiters
+	// (ratelimit.go) is: -hosts can expand to CIDRs/ranges/SRV lookups
+	// whose membership changes over time (see expand.go), so without a
+	// cap a long-running exporter would leak one entry forever per
+	// distinct host string it has ever scanned.
+	hostCancelsMu sync.Mutex
+	hostCancelsLL = list.New()
+	hostCancels   = map[string]*list.Element{}
+)
+
+// maxHostCancels bounds hostCancels the same way maxHostLimiters bounds
+// hostLimiters. Past this, the least-recently-registered host's cancel
+// func is forgotten (not called) - its scan runs to completion normally,
+// it just won't be eagerly canceled if that host later drops out of the
+// target set.
+const maxHostCancels = 10_000
+
+type hostCancelEntry struct {
+	host   string
+	cancel context.CancelFunc
+}
+
+// sdGroup is one entry of the Prometheus HTTP service discovery format:
+// https://prometheus.io/docs/prometheus/latest/http_sd/
+type sdGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// handleTargets serves the currently configured host:port pairs in the
+// Prometheus HTTP SD JSON format.
+func handleTargets(w http.ResponseWriter, r *http.Request) {
+	targetsMu.RLock()
+	rawSpecs := append([]string(nil), hosts...)
+	excludeSpecs := append([]string(nil), excludes...)
+	portsSnapshot := append([]uint16(nil), ports...)
+	targetsMu.RUnlock()
+
+	hostsSnapshot := expandTargets(r.Context(), rawSpecs, excludeSpecs)
+
+	groups := make([]sdGroup, 0, len(hostsSnapshot)*len(portsSnapshot))
+	for _, host := range hostsSnapshot {
+		for _, port := range portsSnapshot {
+			groups = append(groups, sdGroup{
+				Targets: []string{fmt.Sprintf("%s:%d", host, port)},
+				Labels: map[string]string{
+					"host": host,
+					"port": strconv.Itoa(int(port)),
+				},
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(groups); err != nil {
+		slog.Error("failed to encode targets", slog.String("error", err.Error()))
+	}
+}
+
+// watchTargets keeps the host set in sync with -list (via fsnotify) and/or
+// -targets-url (via polling), replacing the one-shot parsing that used to
+// happen only at flag.Parse time.
+func watchTargets(ctx context.Context) {
+	if targetsFileReload && targetsFilePath != "" {
+		go watchTargetsFile(ctx, targetsFilePath)
+	}
+	if targetsURL != "" {
+		go pollTargetsURL(ctx, targetsURL)
+	}
+}
+
+func watchTargetsFile(ctx context.Context, path string) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("failed to watch targets file", slog.String("path", path), slog.String("error", err.Error()))
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(path); err != nil {
+		slog.Error("failed to watch targets file", slog.String("path", path), slog.String("error", err.Error()))
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			newHosts, err := readHostsFile(path)
+			if err != nil {
+				slog.Error("failed to reload targets file", slog.String("path", path), slog.String("error", err.Error()))
+				continue
+			}
+			applyHosts(newHosts)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("targets file watcher error", slog.String("error", err.Error()))
+		}
+	}
+}
+
+func pollTargetsURL(ctx context.Context, url string) {
+	ticker := time.NewTicker(targetsPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			newHosts, err := fetchHostsURL(ctx, url)
+			if err != nil {
+				slog.Error("failed to poll targets url", slog.String("url", url), slog.String("error", err.Error()))
+				continue
+			}
+			applyHosts(newHosts)
+		}
+	}
+}
+
+func readHostsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var newHosts []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		newHosts = append(newHosts, sc.Text())
+	}
+	return newHosts, sc.Err()
+}
+
+func fetchHostsURL(ctx context.Context, url string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var groups []sdGroup
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]struct{}{}
+	var newHosts []string
+	for _, group := range groups {
+		if host, ok := group.Labels["host"]; ok {
+			if _, dup := seen[host]; !dup {
+				seen[host] = struct{}{}
+				newHosts = append(newHosts, host)
+			}
+			continue
+		}
+		for _, target := range group.Targets {
+			host, _, err := net.SplitHostPort(target)
+			if err != nil {
+				host = target
+			}
+			if _, dup := seen[host]; !dup {
+				seen[host] = struct{}{}
+				newHosts = append(newHosts, host)
+			}
+		}
+	}
+
+	return newHosts, nil
+}
+
+// applyHosts swaps in a new host set and cancels any in-flight scans for
+// hosts that were removed.
+func applyHosts(newHosts []string) {
+	sort.Strings(newHosts)
+
+	targetsMu.Lock()
+	oldHosts := hosts
+	hosts = newHosts
+	excludeSpecs := append([]string(nil), excludes...)
+	targetsMu.Unlock()
+
+	// Scans are registered per expanded host, so diff the expanded sets:
+	// dropping a CIDR, range or SRV spec cancels the hosts it expanded to.
+	ctx := context.Background()
+	removed := diffHosts(expandTargets(ctx, oldHosts, excludeSpecs), expandTargets(ctx, newHosts, excludeSpecs))
+	for _, host := range removed {
+		cancelHost(host)
+	}
+
+	if len(removed) > 0 {
+		slog.Info("targets reloaded", slog.Int("hosts", len(newHosts)), slog.Int("removed", len(removed)))
+	}
+}
+
+func diffHosts(oldHosts, newHosts []string) []string {
+	present := make(map[string]struct{}, len(newHosts))
+	for _, h := range newHosts {
+		present[h] = struct{}{}
+	}
+
+	var removed []string
+	for _, h := range oldHosts {
+		if _, ok := present[h]; !ok {
+			removed = append(removed, h)
+		}
+	}
+	return removed
+}
+
+// registerHostContext returns a context tied to host that is canceled
+// when parent is done, when the host is dropped from the target set via
+// applyHosts/cancelHost, or when registerHostContext is called again for
+// the same host.
+func registerHostContext(parent context.Context, host string) context.Context {
+	hostCancelsMu.Lock()
+	defer hostCancelsMu.Unlock()
+
+	if el, ok := hostCancels[host]; ok {
+		el.Value.(*hostCancelEntry).cancel()
+		hostCancelsLL.Remove(el)
+		delete(hostCancels, host)
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	el := hostCancelsLL.PushFront(&hostCancelEntry{host: host, cancel: cancel})
+	hostCancels[host] = el
+
+	if hostCancelsLL.Len() > maxHostCancels {
+		oldest := hostCancelsLL.Back()
+		if oldest != nil {
+			hostCancelsLL.Remove(oldest)
+			delete(hostCancels, oldest.Value.(*hostCancelEntry).host)
+		}
+	}
+
+	return ctx
+}
+
+func cancelHost(host string) {
+	hostCancelsMu.Lock()
+	if el, ok := hostCancels[host]; ok {
+		el.Value.(*hostCancelEntry).cancel()
+		hostCancelsLL.Remove(el)
+		delete(hostCancels, host)
+	}
+	hostCancelsMu.Unlock()
+
+	deleteHostLimiter(host)
+}